@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// loggerCtxKey is the context key under which the per-request logger is
+// stored. It's a distinct value from callerIdentityCtxKey since both share
+// the ctxKey type.
+const loggerCtxKey ctxKey = 1
+
+// logger is the process-wide structured logger. main sets it up from
+// LOG_LEVEL before doing anything else, so it's always safe to use, even
+// for logging that happens outside of a request (startup, shutdown,
+// background cert reloads).
+var logger = newLogger("")
+
+// newLogger builds a logger that emits structured JSON to stdout at the
+// level named by levelName ("debug", "info", "warn", "error"). An empty or
+// unrecognized levelName defaults to "info".
+func newLogger(levelName string) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil {
+		level = slog.LevelInfo
+	}
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	return slog.New(handler)
+}
+
+// loggerFromContext returns the per-request logger stashed by
+// withRequestLogging, tagged with that request's ID, or the package-wide
+// logger if ctx carries none.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerCtxKey).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// withRequestLogging wraps next so that every request carries an
+// X-Request-ID (echoing the caller's if it sent one, otherwise generating
+// one), tags the logger attached to the request context with it, and logs
+// one structured entry per request once it completes.
+func withRequestLogging(base *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := r.Header.Get("X-Request-ID")
+		if reqID == "" {
+			reqID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", reqID)
+
+		reqLogger := base.With("req", reqID)
+		ctx := context.WithValue(r.Context(), loggerCtxKey, reqLogger)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		reqLogger.Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"status", rec.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code
+// written, since net/http doesn't expose it after the fact. It forwards
+// Flush and Unwrap so the streaming (sse.go) and write-deadline
+// (disableWriteDeadline) paths keep working through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// newRequestID generates a random 16-character hex request ID.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// fatal logs msg and err as a structured error entry and exits the process.
+// Every startup failure goes through this single path instead of
+// log.Fatalf, so they're all logged the same structured way before exit.
+func fatal(l *slog.Logger, msg string, err error) {
+	l.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -1,30 +1,102 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Server struct will hold our router (ServeMux) and other server-specific configurations.
 type Server struct {
-	mux  *http.ServeMux
-	addr string
+	mux        *http.ServeMux
+	addr       string
+	httpServer *http.Server
+
+	tlsCertFile  string
+	tlsKeyFile   string
+	clientCAFile string
 }
 
 type Config struct {
 	ListenAddr  string
 	PostgresURL string
 	Schema      string
+
+	// OIDCDisabled skips authentication entirely, for local development.
+	OIDCDisabled bool
+	// OIDCIssuerURL is the OIDC provider's issuer URL, used for discovery.
+	OIDCIssuerURL string
+	// OIDCClientID is the expected audience/client ID of incoming tokens.
+	OIDCClientID string
+	// OIDCAudience, if set and different from OIDCClientID, is checked
+	// against the token's "aud" claim instead of OIDCClientID.
+	OIDCAudience string
+	// OIDCRoleClaim is the claim holding the caller's roles (default "groups").
+	OIDCRoleClaim string
+
+	// ReadTimeout, ReadHeaderTimeout, WriteTimeout and IdleTimeout configure
+	// the underlying http.Server. Handlers that legitimately run longer than
+	// WriteTimeout (migrations) disable it for their response explicitly.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// ShutdownTimeout bounds how long graceful shutdown waits for in-flight
+	// requests to finish before giving up.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable TLS when both are set. The files are
+	// reloaded from disk on each handshake so certs can be rotated without
+	// restarting the server.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile, if set, enables mTLS: client certificates are required
+	// and verified against the CA(s) in this file.
+	ClientCAFile string
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime tune the connection pool
+	// shared by the long-lived *roll.Roll and *state.State used by every
+	// handler.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// LockTimeoutMs is the Postgres lock_timeout (in milliseconds) pgroll
+	// applies to its DDL operations.
+	LockTimeoutMs int
+
+	// LogLevel selects the minimum slog level logged ("debug", "info",
+	// "warn", "error"). Defaults to "info".
+	LogLevel string
 }
 
-// NewServer creates and returns a new Server instance.
+// NewServer creates and returns a new Server instance from cfg.
 // It initializes a new ServeMux for routing.
-func NewServer(listenAddr string) *Server {
+func NewServer(cfg Config) *Server {
+	mux := http.NewServeMux() // Using a new ServeMux allows for more control than DefaultServeMux
+
 	return &Server{
-		mux:  http.NewServeMux(), // Using a new ServeMux allows for more control than DefaultServeMux
-		addr: listenAddr,
+		mux:  mux,
+		addr: cfg.ListenAddr,
+		httpServer: &http.Server{
+			Addr:              cfg.ListenAddr,
+			Handler:           withRequestLogging(logger, mux),
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+		},
+		tlsCertFile:  cfg.TLSCertFile,
+		tlsKeyFile:   cfg.TLSKeyFile,
+		clientCAFile: cfg.ClientCAFile,
 	}
 }
 
@@ -32,39 +104,134 @@ func NewServer(listenAddr string) *Server {
 // This is a convenience method on our Server struct.
 func (s *Server) AddHandlerFunc(pattern string, handlerFunc http.HandlerFunc) {
 	s.mux.HandleFunc(pattern, handlerFunc)
-	log.Printf("Registered handler for pattern: %s", pattern)
+	logger.Info("registered handler", "pattern", pattern)
 }
 
 // AddHandler registers an http.Handler for the given pattern.
 // Use this if your handler is a struct implementing http.Handler.
 func (s *Server) AddHandler(pattern string, handler http.Handler) {
 	s.mux.Handle(pattern, handler)
-	log.Printf("Registered handler (http.Handler) for pattern: %s", pattern)
+	logger.Info("registered handler", "pattern", pattern, "kind", "http.Handler")
+}
+
+// AddProtectedHandlerFunc registers handlerFunc for pattern behind OIDC
+// authentication, requiring the caller to hold at least one of requiredRoles.
+// If auth is nil (OIDC disabled for local development), handlerFunc is
+// registered unprotected.
+func (s *Server) AddProtectedHandlerFunc(pattern string, auth *OIDCAuthenticator, requiredRoles []string, handlerFunc http.HandlerFunc) {
+	if auth == nil {
+		s.AddHandlerFunc(pattern, handlerFunc)
+		return
+	}
+	s.AddHandlerFunc(pattern, auth.Middleware(requiredRoles, handlerFunc))
 }
 
-// Start begins listening for HTTP requests on the configured address.
+// Start begins listening for HTTP requests on the configured address. It
+// blocks until the server stops, returning nil if it stopped because of a
+// call to Shutdown.
 func (s *Server) Start() error {
-	log.Printf("Server starting on %s...", s.addr)
-	// For production, you might want more sophisticated server configuration
-	// (e.g., ReadTimeout, WriteTimeout, TLS).
-	// http.Server instance allows for this:
-	// httpServer := &http.Server{
-	//  Addr: s.addr,
-	//  Handler: s.mux,
-	//  ReadTimeout: 10 * time.Second,
-	//  WriteTimeout: 10 * time.Second,
-	// }
-	// return httpServer.ListenAndServe()
-
-	// For simplicity, we use http.ListenAndServe with our custom mux
-	return http.ListenAndServe(s.addr, s.mux)
+	if s.tlsCertFile != "" && s.tlsKeyFile != "" {
+		return s.startTLS()
+	}
+
+	logger.Info("server starting", "addr", s.addr)
+	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// startTLS configures s.httpServer for TLS (and, if clientCAFile is set,
+// mTLS) and starts listening. Certificates are loaded through a certReloader
+// so that rotating the files on disk takes effect without a restart.
+func (s *Server) startTLS() error {
+	reloader := newCertReloader(s.tlsCertFile, s.tlsKeyFile)
+	tlsConfig := &tls.Config{GetCertificate: reloader.GetCertificate}
+
+	if s.clientCAFile != "" {
+		caCert, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CA file %q: %w", s.clientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in client CA file %q", s.clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		logger.Info("mTLS enabled", "client_ca_file", s.clientCAFile)
+	}
+
+	s.httpServer.TLSConfig = tlsConfig
+
+	logger.Info("server starting with TLS", "addr", s.addr, "cert_file", s.tlsCertFile)
+	if err := s.httpServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the server: it stops accepting new connections
+// and waits for in-flight requests (including long-running migrations) to
+// finish, or for ctx to be done, whichever happens first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	logger.Info("shutting down server")
+	return s.httpServer.Shutdown(ctx)
+}
+
+// certReloader serves a TLS certificate loaded from certFile/keyFile,
+// reloading it whenever the cert file's mtime changes so that certificates
+// can be rotated on disk without restarting the process.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// GetCertificate implements the signature expected by tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("stat TLS cert file %q: %w", c.certFile, err)
+	}
+
+	if c.cert == nil || info.ModTime().After(c.modTime) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS key pair: %w", err)
+		}
+		c.cert = &cert
+		c.modTime = info.ModTime()
+		logger.Info("loaded TLS certificate", "cert_file", c.certFile)
+	}
+
+	return c.cert, nil
+}
+
+// disableWriteDeadline removes the http.Server's WriteTimeout for this
+// response. Handlers that can legitimately run far longer than a typical
+// request — migrations against large tables can take minutes — call this
+// before doing any real work.
+func disableWriteDeadline(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn("failed to disable write deadline", "error", err)
+	}
 }
 
 // --- Handler Functions ---
 
 // helloHandler is a simple handler that responds with "Hello, World!".
 func helloHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request for %s from %s", r.URL.Path, r.RemoteAddr)
+	loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, "Hello, World!")
 }
@@ -85,66 +252,184 @@ func getConfigFromEnv() (Config, error) {
 		schema = "public"
 	}
 
+	oidcDisabled, _ := strconv.ParseBool(os.Getenv("DISABLE_OIDC_AUTH"))
+
 	return Config{
 		ListenAddr:  listenAddr,
 		PostgresURL: postgresURL,
 		Schema:      schema,
+
+		OIDCDisabled:  oidcDisabled,
+		OIDCIssuerURL: os.Getenv("OIDC_ISSUER_URL"),
+		OIDCClientID:  os.Getenv("OIDC_CLIENT_ID"),
+		OIDCAudience:  os.Getenv("OIDC_AUDIENCE"),
+		OIDCRoleClaim: os.Getenv("OIDC_ROLE_CLAIM"),
+
+		ReadTimeout:       durationEnv("READ_TIMEOUT", 10*time.Second),
+		ReadHeaderTimeout: durationEnv("READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      durationEnv("WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       durationEnv("IDLE_TIMEOUT", 120*time.Second),
+		ShutdownTimeout:   durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+		ClientCAFile: os.Getenv("CLIENT_CA_FILE"),
+
+		MaxOpenConns:    intEnv("MAX_OPEN_CONNS", 10),
+		MaxIdleConns:    intEnv("MAX_IDLE_CONNS", 10),
+		ConnMaxLifetime: durationEnv("CONN_MAX_LIFETIME", time.Hour),
+		LockTimeoutMs:   intEnv("LOCK_TIMEOUT_MS", 500),
+
+		LogLevel: os.Getenv("LOG_LEVEL"),
 	}, nil
 }
 
-func initHTTPServer(cfg Config) *Server {
+// intEnv reads an int from the environment variable key, falling back to def
+// if it's unset or unparseable.
+func intEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Warn("invalid integer env var, using default", "key", key, "value", v, "default", def, "error", err)
+		return def
+	}
+	return n
+}
+
+// durationEnv reads a time.Duration from the environment variable key,
+// falling back to def if it's unset or unparseable.
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warn("invalid duration env var, using default", "key", key, "value", v, "default", def, "error", err)
+		return def
+	}
+	return d
+}
+
+func initHTTPServer(cfg Config) (*Server, error) {
 	// Create a new server instance
-	server := NewServer(cfg.ListenAddr)
+	server := NewServer(cfg)
+
+	var auth *OIDCAuthenticator
+	if cfg.OIDCDisabled {
+		logger.Warn("OIDC authentication is disabled (DISABLE_OIDC_AUTH=true); migration endpoints are unprotected")
+	} else {
+		a, err := NewOIDCAuthenticator(context.Background(), cfg.OIDCIssuerURL, cfg.OIDCClientID, cfg.OIDCAudience, cfg.OIDCRoleClaim)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up OIDC authenticator: %w", err)
+		}
+		auth = a
+	}
+
+	// Construct the single, long-lived *roll.Roll (and its connection pool)
+	// shared by every handler, instead of opening a fresh one per request.
+	deps, err := newHandlerDeps(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize pgroll: %w", err)
+	}
 
 	// Add the "Hello, World!" handler
 	server.AddHandlerFunc("/hello", helloHandler)
 
 	// Add the init handler
-	server.AddHandlerFunc("/init", initHandler(cfg))
+	server.AddProtectedHandlerFunc("/init", auth, endpointRoles["/init"], initHandler(deps))
 
 	// Add the start migration handler
-	server.AddHandlerFunc("/start-migration", startMigrationHandler(cfg))
+	server.AddProtectedHandlerFunc("/start-migration", auth, endpointRoles["/start-migration"], startMigrationHandler(deps))
+
+	// Add the streaming start migration handler
+	server.AddProtectedHandlerFunc("/start-migration/stream", auth, endpointRoles["/start-migration/stream"], startMigrationStreamHandler(deps))
 
 	// Add the complete migration handler
-	server.AddHandlerFunc("/complete-migration", completeMigrationHandler(cfg))
+	server.AddProtectedHandlerFunc("/complete-migration", auth, endpointRoles["/complete-migration"], completeMigrationHandler(deps))
 
 	// Add the start and complete migration handler
-	server.AddHandlerFunc("/start-and-complete-migration", startAndCompleteMigrationHandler(cfg))
+	server.AddProtectedHandlerFunc("/start-and-complete-migration", auth, endpointRoles["/start-and-complete-migration"], startAndCompleteMigrationHandler(deps))
 
 	// Add the rollback handler
-	server.AddHandlerFunc("/rollback", rollbackHandler(cfg))
+	server.AddProtectedHandlerFunc("/rollback", auth, endpointRoles["/rollback"], rollbackHandler(deps))
+
+	// Add the read-only status/history/schema handlers
+	server.AddProtectedHandlerFunc("/status", auth, endpointRoles["/status"], statusHandler(deps))
+	server.AddProtectedHandlerFunc("/migrations", auth, endpointRoles["/migrations"], migrationsHandler(deps))
+	server.AddProtectedHandlerFunc("/latest", auth, endpointRoles["/latest"], latestHandler(deps))
+	server.AddProtectedHandlerFunc("/schema", auth, endpointRoles["/schema"], schemaHandler(deps))
+
+	// Add the liveness/readiness probes. These are intentionally not behind
+	// auth, since they're meant for load balancer / orchestrator health
+	// checks rather than API clients.
+	server.AddHandlerFunc("/healthz", healthzHandler(deps))
+	server.AddHandlerFunc("/readyz", readyzHandler(deps))
 
 	// Example: Add a handler that responds to the root path "/"
 	server.AddHandlerFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// If the path is not exactly "/", it means it wasn't caught by other handlers.
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
-			log.Printf("404 Not Found for %s", r.URL.Path)
+			loggerFromContext(r.Context()).Info("404 not found", "path", r.URL.Path)
 			return
 		}
-		log.Printf("Received request for %s from %s", r.URL.Path, r.RemoteAddr)
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintln(w, "Welcome to the simple Go HTTP server!")
 		fmt.Fprintln(w, "Try /hello or /time")
 	})
 
-	return server
+	return server, nil
 }
 
 func main() {
 	// Get PostgreSQL connection string from environment variable
 	cfg, err := getConfigFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to get config from env: %v", err)
+		fatal(logger, "failed to get config from env", err)
 	}
+	logger = newLogger(cfg.LogLevel)
 
 	// Initialize the server with all routes
-	server := initHTTPServer(cfg)
-
-	// Start the server
-	// The server will run until an error occurs or the program is terminated.
-	err = server.Start()
+	server, err := initHTTPServer(cfg)
 	if err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		fatal(logger, "failed to initialize server", err)
+	}
+
+	// Run the server in the background so we can watch for shutdown signals.
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.Start()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serveErrCh:
+		if err != nil {
+			fatal(logger, "server failed to start", err)
+		}
+
+	case <-ctx.Done():
+		stop()
+		logger.Info("received shutdown signal, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fatal(logger, "graceful shutdown failed", err)
+		}
+
+		if err := <-serveErrCh; err != nil {
+			fatal(logger, "server failed to start", err)
+		}
+
+		logger.Info("server stopped cleanly")
 	}
 }
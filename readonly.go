@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/xataio/pgroll/pkg/roll"
+	"github.com/xataio/pgroll/pkg/schema"
+)
+
+// writeJSONBody writes body to w as JSON with the given status code. Unlike
+// writeJSONResponse, it's for endpoints that return an arbitrary JSON
+// payload rather than the {success, message, error} shape mutating handlers
+// use.
+func writeJSONBody(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Warn("failed to encode JSON response", "error", err)
+	}
+}
+
+// statusHandler reports whether a migration is in progress, complete, or
+// has never been run for the server's configured schema.
+func statusHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		status, err := deps.roll.State().Status(r.Context(), deps.cfg.Schema)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("failed to get migration status", "error", err, "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "Failed to get migration status", http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSONBody(w, http.StatusOK, status)
+	}
+}
+
+// migrationsHandler returns the ordered history of migrations applied to the
+// server's configured schema.
+func migrationsHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		history, err := deps.roll.State().SchemaHistory(r.Context(), deps.cfg.Schema)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("failed to get migration history", "error", err, "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "Failed to get migration history", http.StatusInternalServerError, err)
+			return
+		}
+		if len(history) == 0 {
+			writeJSONResponse(w, false, "No migrations have been applied to this schema", http.StatusNotFound, nil)
+			return
+		}
+
+		writeJSONBody(w, http.StatusOK, history)
+	}
+}
+
+// latestHandler returns the name of the latest applied migration and the
+// versioned view schema it created.
+func latestHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		version, err := deps.roll.State().LatestVersion(r.Context(), deps.cfg.Schema)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("failed to get latest version", "error", err, "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "Failed to get latest version", http.StatusInternalServerError, err)
+			return
+		}
+		if version == nil || *version == "" {
+			writeJSONResponse(w, false, "No migrations have been applied to this schema", http.StatusNotFound, nil)
+			return
+		}
+
+		writeJSONBody(w, http.StatusOK, map[string]string{
+			"name":          *version,
+			"versionSchema": roll.VersionedSchemaName(deps.cfg.Schema, *version),
+		})
+	}
+}
+
+// schemaHandler returns the schema snapshot pgroll currently tracks for the
+// server's configured schema, as either JSON (the default, and pgroll's
+// native representation) or a best-effort SQL reconstruction.
+func schemaHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "sql" {
+			writeJSONResponse(w, false, `format must be "json" or "sql"`, http.StatusBadRequest, nil)
+			return
+		}
+
+		sc, err := deps.roll.State().ReadSchema(r.Context(), deps.cfg.Schema)
+		if err != nil {
+			loggerFromContext(r.Context()).Error("failed to read schema", "error", err, "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "Failed to read schema", http.StatusInternalServerError, err)
+			return
+		}
+
+		if format == "sql" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, renderSchemaSQL(sc))
+			return
+		}
+
+		writeJSONBody(w, http.StatusOK, sc)
+	}
+}
+
+// renderSchemaSQL renders a best-effort CREATE TABLE reconstruction of sc.
+// It's meant as a readable snapshot of the schema pgroll currently tracks,
+// not a replayable migration script, so it's not guaranteed to reproduce
+// the exact DDL that produced the schema (indexes and constraints beyond
+// the primary key are omitted).
+func renderSchemaSQL(sc *schema.Schema) string {
+	tableNames := make([]string, 0, len(sc.Tables))
+	for name, table := range sc.Tables {
+		if table.Deleted {
+			continue
+		}
+		tableNames = append(tableNames, name)
+	}
+	sort.Strings(tableNames)
+
+	var b strings.Builder
+	for _, name := range tableNames {
+		table := sc.Tables[name]
+
+		colNames := make([]string, 0, len(table.Columns))
+		for colName, col := range table.Columns {
+			if col.Deleted {
+				continue
+			}
+			colNames = append(colNames, colName)
+		}
+		sort.Strings(colNames)
+
+		fmt.Fprintf(&b, "CREATE TABLE %s (\n", table.Name)
+		for _, colName := range colNames {
+			col := table.Columns[colName]
+			fmt.Fprintf(&b, "    %s %s", col.Name, col.Type)
+			if !col.Nullable {
+				b.WriteString(" NOT NULL")
+			}
+			if col.Default != nil {
+				fmt.Fprintf(&b, " DEFAULT %s", *col.Default)
+			}
+			b.WriteString(",\n")
+		}
+		if len(table.PrimaryKey) > 0 {
+			fmt.Fprintf(&b, "    PRIMARY KEY (%s)\n", strings.Join(table.PrimaryKey, ", "))
+		} else {
+			// Trim the trailing comma left by the last column.
+			s := b.String()
+			b.Reset()
+			b.WriteString(strings.TrimSuffix(s, ",\n") + "\n")
+		}
+		b.WriteString(");\n\n")
+	}
+
+	return b.String()
+}
+
+// healthzHandler reports 200 if the server can reach Postgres, 503 otherwise.
+// It is not authenticated, since it's meant for load balancer / orchestrator
+// health checks.
+func healthzHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deps.roll.State().PgConn().PingContext(r.Context()); err != nil {
+			logger.Warn("health check failed", "error", err)
+			writeJSONResponse(w, false, "Database unreachable", http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSONResponse(w, true, "OK", http.StatusOK, nil)
+	}
+}
+
+// readyzHandler reports 200 if Postgres is reachable and the pgroll state
+// schema has been initialized, 503 otherwise. Like healthzHandler, it is
+// not authenticated.
+func readyzHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deps.roll.State().PgConn().PingContext(r.Context()); err != nil {
+			logger.Warn("readiness check failed: database unreachable", "error", err)
+			writeJSONResponse(w, false, "Database unreachable", http.StatusServiceUnavailable, err)
+			return
+		}
+
+		initialized, err := deps.roll.State().IsInitialized(r.Context())
+		if err != nil {
+			logger.Warn("readiness check failed: could not check pgroll state schema", "error", err)
+			writeJSONResponse(w, false, "Failed to check pgroll state schema", http.StatusServiceUnavailable, err)
+			return
+		}
+		if !initialized {
+			writeJSONResponse(w, false, "pgroll state schema is not initialized", http.StatusServiceUnavailable, nil)
+			return
+		}
+
+		writeJSONResponse(w, true, "OK", http.StatusOK, nil)
+	}
+}
@@ -2,65 +2,119 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
+	"sync"
 
 	"github.com/xataio/pgroll/pkg/backfill"
+	"github.com/xataio/pgroll/pkg/db"
 	"github.com/xataio/pgroll/pkg/migrations"
 	"github.com/xataio/pgroll/pkg/roll"
 	"github.com/xataio/pgroll/pkg/state"
 )
 
-func NewRoll(ctx context.Context, postgresURL string, schema string) (*roll.Roll, error) {
-	const lockTimeoutMs = 500
+// handlerDeps bundles the dependencies shared by every migration handler: a
+// single long-lived *roll.Roll (and the *state.State it wraps), plus a lock
+// that serializes mutating operations (Start/Complete/Rollback) against the
+// configured schema so concurrent HTTP calls can't race pgroll's state
+// table.
+type handlerDeps struct {
+	cfg  Config
+	roll *roll.Roll
+
+	// migrationMu guards cfg.Schema against concurrent mutating operations.
+	migrationMu sync.Mutex
+}
 
-	state, err := state.New(ctx, postgresURL, "pgroll")
+// newHandlerDeps opens the connection pool, constructs the shared
+// *roll.Roll, and runs its one-time Init. Call this once at startup, not
+// per-request: opening a fresh *roll.Roll (and re-running Init) for every
+// request thrashes Postgres and races pgroll's own bootstrap.
+func newHandlerDeps(ctx context.Context, cfg Config) (*handlerDeps, error) {
+	r, err := NewRoll(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	roll, err := roll.New(ctx, postgresURL, "public", state, roll.WithLockTimeoutMs(lockTimeoutMs))
+	if err := r.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	return &handlerDeps{cfg: cfg, roll: r}, nil
+}
+
+// tryLockMigration attempts to acquire the migration lock for cfg.Schema
+// without blocking. It returns false if a mutating operation against that
+// schema is already in flight; callers should respond 409 Conflict in that
+// case. Callers must call unlockMigration once the operation completes -
+// for asynchronous operations, that's the background goroutine performing
+// the work, not necessarily the handler itself.
+func (d *handlerDeps) tryLockMigration() bool {
+	return d.migrationMu.TryLock()
+}
+
+// unlockMigration releases the lock acquired by tryLockMigration.
+func (d *handlerDeps) unlockMigration() {
+	d.migrationMu.Unlock()
+}
+
+// NewRoll opens the shared connection pool and constructs a *roll.Roll for
+// cfg.Schema, with pool size and lock timeout tuned from cfg. It does not
+// call Init; callers that need the pgroll schema bootstrapped must do that
+// themselves.
+func NewRoll(ctx context.Context, cfg Config) (*roll.Roll, error) {
+	st, err := state.New(ctx, cfg.PostgresURL, "pgroll")
 	if err != nil {
 		return nil, err
 	}
+	configurePool(st.PgConn(), cfg)
 
-	if err := roll.Init(ctx); err != nil {
+	r, err := roll.New(ctx, cfg.PostgresURL, cfg.Schema, st, roll.WithLockTimeoutMs(cfg.LockTimeoutMs))
+	if err != nil {
 		return nil, err
 	}
+	if rdb, ok := r.PgConn().(*db.RDB); ok {
+		configurePool(rdb.DB, cfg)
+	}
 
-	return roll, nil
+	return r, nil
+}
+
+// configurePool applies cfg's connection pool tuning to conn.
+func configurePool(conn *sql.DB, cfg Config) {
+	conn.SetMaxOpenConns(cfg.MaxOpenConns)
+	conn.SetMaxIdleConns(cfg.MaxIdleConns)
+	conn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 }
 
 // writeJSONResponse writes a JSON response with the given success status and message
 func writeJSONResponse(w http.ResponseWriter, success bool, message string, statusCode int, err error) {
+	body := struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+		Error   string `json:"error,omitempty"`
+	}{Success: success, Message: message}
+	if err != nil {
+		body.Error = err.Error()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if statusCode != http.StatusOK {
 		w.WriteHeader(statusCode)
 	}
-	if err != nil {
-		fmt.Fprintf(w, `{"success": %t, "message": "%s", "error": "%v"}`, success, message, err)
-	} else {
-		fmt.Fprintf(w, `{"success": %t, "message": "%s"}`, success, message)
+	if encErr := json.NewEncoder(w).Encode(body); encErr != nil {
+		logger.Error("failed to encode JSON response", "error", encErr)
 	}
 }
 
-// initHandler initializes pgroll with the given configuration
-func initHandler(cfg Config) http.HandlerFunc {
+// initHandler (re-)initializes the pgroll schema on the shared roll instance.
+func initHandler(deps *handlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request for %s from %s", r.URL.Path, r.RemoteAddr)
-
-		roll, err := NewRoll(context.Background(), cfg.PostgresURL, cfg.Schema)
-		if err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
-			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
-			return
-		}
-		defer roll.Close()
+		loggerFromContext(r.Context()).Info("received request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()))
 
-		if err := roll.Init(context.Background()); err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
+		if err := deps.roll.Init(r.Context()); err != nil {
+			loggerFromContext(r.Context()).Error("failed to initialize pgroll", "error", err)
 			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
 			return
 		}
@@ -70,9 +124,10 @@ func initHandler(cfg Config) http.HandlerFunc {
 }
 
 // startMigrationHandler receives a migration JSON and initiates the migration operation
-func startMigrationHandler(cfg Config) http.HandlerFunc {
+func startMigrationHandler(deps *handlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received startMigration request for %s from %s", r.URL.Path, r.RemoteAddr)
+		loggerFromContext(r.Context()).Info("received startMigration request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+		disableWriteDeadline(w)
 
 		if r.Method != http.MethodPost {
 			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
@@ -87,7 +142,7 @@ func startMigrationHandler(cfg Config) http.HandlerFunc {
 		}
 		err := json.NewDecoder(r.Body).Decode(&body)
 		if err != nil {
-			log.Printf("Failed to read request body: %v", err)
+			loggerFromContext(r.Context()).Warn("failed to read request body", "error", err)
 			writeJSONResponse(w, false, "Failed to read request body", http.StatusBadRequest, err)
 			return
 		}
@@ -97,23 +152,21 @@ func startMigrationHandler(cfg Config) http.HandlerFunc {
 			Operations: body.Operations,
 		})
 		if err != nil {
-			log.Printf("Failed to parse migration: %v", err)
+			loggerFromContext(r.Context()).Warn("failed to parse migration", "error", err, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to parse migration", http.StatusBadRequest, err)
 			return
 		}
 
-		// Initialize roll instance
-		roll, err := NewRoll(context.Background(), cfg.PostgresURL, cfg.Schema)
-		if err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
-			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
+		if !deps.tryLockMigration() {
+			loggerFromContext(r.Context()).Warn("rejecting startMigration: a migration is already in progress", "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "A migration is already in progress for this schema", http.StatusConflict, nil)
 			return
 		}
-		defer roll.Close()
+		defer deps.unlockMigration()
 
 		// Start the migration
-		if err := roll.Start(context.Background(), migration, &backfill.Config{}); err != nil {
-			log.Printf("Failed to start migration: %v", err)
+		if err := deps.roll.Start(r.Context(), migration, &backfill.Config{}); err != nil {
+			loggerFromContext(r.Context()).Error("failed to start migration", "error", err, "migration", migration.Name, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to start migration", http.StatusInternalServerError, err)
 			return
 		}
@@ -123,27 +176,26 @@ func startMigrationHandler(cfg Config) http.HandlerFunc {
 }
 
 // completeMigrationHandler completes a previously started migration
-func completeMigrationHandler(cfg Config) http.HandlerFunc {
+func completeMigrationHandler(deps *handlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received completeMigration request for %s from %s", r.URL.Path, r.RemoteAddr)
+		loggerFromContext(r.Context()).Info("received completeMigration request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+		disableWriteDeadline(w)
 
 		if r.Method != http.MethodPost {
 			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
 			return
 		}
 
-		// Initialize roll instance
-		roll, err := NewRoll(context.Background(), cfg.PostgresURL, cfg.Schema)
-		if err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
-			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
+		if !deps.tryLockMigration() {
+			loggerFromContext(r.Context()).Warn("rejecting completeMigration: a migration is already in progress", "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "A migration is already in progress for this schema", http.StatusConflict, nil)
 			return
 		}
-		defer roll.Close()
+		defer deps.unlockMigration()
 
 		// Complete the migration
-		if err := roll.Complete(context.Background()); err != nil {
-			log.Printf("Failed to complete migration: %v", err)
+		if err := deps.roll.Complete(r.Context()); err != nil {
+			loggerFromContext(r.Context()).Error("failed to complete migration", "error", err, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to complete migration", http.StatusInternalServerError, err)
 			return
 		}
@@ -153,9 +205,10 @@ func completeMigrationHandler(cfg Config) http.HandlerFunc {
 }
 
 // startAndCompleteMigrationHandler starts and immediately completes a migration
-func startAndCompleteMigrationHandler(cfg Config) http.HandlerFunc {
+func startAndCompleteMigrationHandler(deps *handlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received startAndCompleteMigration request for %s from %s", r.URL.Path, r.RemoteAddr)
+		loggerFromContext(r.Context()).Info("received startAndCompleteMigration request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+		disableWriteDeadline(w)
 
 		if r.Method != http.MethodPost {
 			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
@@ -170,7 +223,7 @@ func startAndCompleteMigrationHandler(cfg Config) http.HandlerFunc {
 		}
 		err := json.NewDecoder(r.Body).Decode(&body)
 		if err != nil {
-			log.Printf("Failed to read request body: %v", err)
+			loggerFromContext(r.Context()).Warn("failed to read request body", "error", err)
 			writeJSONResponse(w, false, "Failed to read request body", http.StatusInternalServerError, err)
 			return
 		}
@@ -180,30 +233,28 @@ func startAndCompleteMigrationHandler(cfg Config) http.HandlerFunc {
 			Operations: body.Operations,
 		})
 		if err != nil {
-			log.Printf("Failed to parse migration: %v", err)
+			loggerFromContext(r.Context()).Warn("failed to parse migration", "error", err, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to parse migration", http.StatusInternalServerError, err)
 			return
 		}
 
-		// Initialize roll instance
-		roll, err := NewRoll(context.Background(), cfg.PostgresURL, cfg.Schema)
-		if err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
-			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
+		if !deps.tryLockMigration() {
+			loggerFromContext(r.Context()).Warn("rejecting startAndCompleteMigration: a migration is already in progress", "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "A migration is already in progress for this schema", http.StatusConflict, nil)
 			return
 		}
-		defer roll.Close()
+		defer deps.unlockMigration()
 
 		// Start the migration
-		if err := roll.Start(context.Background(), migration, &backfill.Config{}); err != nil {
-			log.Printf("Failed to start migration: %v", err)
+		if err := deps.roll.Start(r.Context(), migration, &backfill.Config{}); err != nil {
+			loggerFromContext(r.Context()).Error("failed to start migration", "error", err, "migration", migration.Name, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to start migration", http.StatusInternalServerError, err)
 			return
 		}
 
 		// Complete the migration
-		if err := roll.Complete(context.Background()); err != nil {
-			log.Printf("Failed to complete migration: %v", err)
+		if err := deps.roll.Complete(r.Context()); err != nil {
+			loggerFromContext(r.Context()).Error("failed to complete migration", "error", err, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to complete migration", http.StatusInternalServerError, err)
 			return
 		}
@@ -213,27 +264,26 @@ func startAndCompleteMigrationHandler(cfg Config) http.HandlerFunc {
 }
 
 // rollbackHandler rolls back a previously started migration
-func rollbackHandler(cfg Config) http.HandlerFunc {
+func rollbackHandler(deps *handlerDeps) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received rollback request for %s from %s", r.URL.Path, r.RemoteAddr)
+		loggerFromContext(r.Context()).Info("received rollback request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+		disableWriteDeadline(w)
 
 		if r.Method != http.MethodPost {
 			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
 			return
 		}
 
-		// Initialize roll instance
-		roll, err := NewRoll(context.Background(), cfg.PostgresURL, cfg.Schema)
-		if err != nil {
-			log.Printf("Failed to initialize pgroll: %v", err)
-			writeJSONResponse(w, false, "Failed to initialize pgroll", http.StatusInternalServerError, err)
+		if !deps.tryLockMigration() {
+			loggerFromContext(r.Context()).Warn("rejecting rollback: a migration is already in progress", "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "A migration is already in progress for this schema", http.StatusConflict, nil)
 			return
 		}
-		defer roll.Close()
+		defer deps.unlockMigration()
 
 		// Rollback the migration
-		if err := roll.Rollback(context.Background()); err != nil {
-			log.Printf("Failed to rollback migration: %v", err)
+		if err := deps.roll.Rollback(r.Context()); err != nil {
+			loggerFromContext(r.Context()).Error("failed to rollback migration", "error", err, "schema", deps.cfg.Schema)
 			writeJSONResponse(w, false, "Failed to rollback migration", http.StatusInternalServerError, err)
 			return
 		}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xataio/pgroll/pkg/backfill"
+	"github.com/xataio/pgroll/pkg/migrations"
+	"github.com/xataio/pgroll/pkg/roll"
+)
+
+// backfillProgress is the payload of an `event: progress` SSE frame emitted
+// as a table backfill advances.
+type backfillProgress struct {
+	Table     string  `json:"table"`
+	RowsDone  int64   `json:"rows_done"`
+	RowsTotal int64   `json:"rows_total"`
+	Pct       float64 `json:"pct"`
+}
+
+// startMigrationStreamHandler behaves like startMigrationHandler, but streams
+// backfill progress to the client over Server-Sent Events as it happens
+// instead of blocking until the whole migration completes. The stream ends
+// with `event: done` on success or `event: error` if the migration fails.
+// If the client disconnects, the migration is cancelled between batches.
+func startMigrationStreamHandler(deps *handlerDeps) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loggerFromContext(r.Context()).Info("received startMigration/stream request", "path", r.URL.Path, "remote_addr", r.RemoteAddr, "caller", callerIdentity(r.Context()), "schema", deps.cfg.Schema)
+		disableWriteDeadline(w)
+
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, false, "Method not allowed", http.StatusMethodNotAllowed, nil)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONResponse(w, false, "Streaming not supported by this response writer", http.StatusInternalServerError, nil)
+			return
+		}
+
+		// Read the migration JSON from the request body
+		defer r.Body.Close()
+		var body struct {
+			Name       string          `json:"name"`
+			Operations json.RawMessage `json:"operations"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			loggerFromContext(r.Context()).Warn("failed to read request body", "error", err)
+			writeJSONResponse(w, false, "Failed to read request body", http.StatusBadRequest, err)
+			return
+		}
+
+		migration, err := migrations.ParseMigration(&migrations.RawMigration{
+			Name:       body.Name,
+			Operations: body.Operations,
+		})
+		if err != nil {
+			loggerFromContext(r.Context()).Warn("failed to parse migration", "error", err, "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "Failed to parse migration", http.StatusBadRequest, err)
+			return
+		}
+
+		if !deps.tryLockMigration() {
+			loggerFromContext(r.Context()).Warn("rejecting startMigration/stream: a migration is already in progress", "schema", deps.cfg.Schema)
+			writeJSONResponse(w, false, "A migration is already in progress for this schema", http.StatusConflict, nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		flusher.Flush()
+
+		progress := make(chan backfillProgress)
+		migrationDone := make(chan error, 1)
+
+		go func() {
+			defer deps.unlockMigration()
+			migrationDone <- runMigrationWithProgress(r.Context(), deps.roll, migration, progress)
+		}()
+
+		heartbeat := time.NewTicker(time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case p, ok := <-progress:
+				if !ok {
+					progress = nil
+					continue
+				}
+				writeSSEEvent(w, "progress", p)
+				flusher.Flush()
+
+			case err := <-migrationDone:
+				if err != nil {
+					loggerFromContext(r.Context()).Error("failed to stream migration", "migration", migration.Name, "schema", deps.cfg.Schema, "error", err)
+					writeSSEEvent(w, "error", map[string]string{"error": err.Error()})
+				} else {
+					writeSSEEvent(w, "done", map[string]string{"message": "Migration started successfully"})
+				}
+				flusher.Flush()
+				return
+
+			case <-heartbeat.C:
+				fmt.Fprint(w, ":\n\n") // comment frame, keeps intermediaries from timing out the connection
+				flusher.Flush()
+
+			case <-r.Context().Done():
+				loggerFromContext(r.Context()).Info("client disconnected before migration finished; cancelling", "path", r.URL.Path, "migration", migration.Name, "schema", deps.cfg.Schema)
+				return
+			}
+		}
+	}
+}
+
+// writeSSEEvent writes a single Server-Sent Events frame with the given
+// event name and a JSON-encoded data payload.
+func writeSSEEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logger.Warn("failed to marshal SSE payload", "event", event, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// runMigrationWithProgress runs the DDL phase of migration and then backfills
+// each affected table itself (rather than delegating to roll.Start), so that
+// it can attach a per-table progress callback and report it on progress. It
+// closes progress once every table has been backfilled, or an error aborts
+// the migration. ctx is checked between batches so a client disconnect stops
+// the backfill.
+func runMigrationWithProgress(ctx context.Context, m *roll.Roll, migration *migrations.Migration, progress chan<- backfillProgress) error {
+	defer close(progress)
+
+	tables, err := m.StartDDLOperations(ctx, migration)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		bfCfg := backfill.NewConfig()
+		bfCfg.AddCallback(func(done, total int64) {
+			pct := 0.0
+			if total > 0 {
+				pct = 100 * float64(done) / float64(total)
+			}
+			select {
+			case progress <- backfillProgress{Table: table.Name, RowsDone: done, RowsTotal: total, Pct: pct}:
+			case <-ctx.Done():
+			}
+		})
+
+		bf := backfill.New(m.PgConn(), bfCfg)
+		if err := bf.Start(ctx, table); err != nil {
+			if rbErr := m.Rollback(ctx); rbErr != nil {
+				return fmt.Errorf("backfill %q failed: %w (rollback also failed: %v)", table.Name, err, rbErr)
+			}
+			return fmt.Errorf("backfill %q failed: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}